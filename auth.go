@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Device is a registered tracker allowed to post positions. Token is only
+// ever populated right after creation; it is never read back from the
+// database, only its hash is stored.
+type Device struct {
+	ID        int64  `json:"id"`
+	Name      string `json:"name"`
+	CreatedAt string `json:"createdAt"`
+	Token     string `json:"token,omitempty"`
+}
+
+var errUnauthorized = errors.New("unauthorized")
+
+type deviceCtxKey struct{}
+
+// withDevice attaches the authenticated device to ctx, so handlers
+// running behind authDevice routes don't need to re-authenticate.
+func withDevice(ctx context.Context, d *Device) context.Context {
+	return context.WithValue(ctx, deviceCtxKey{}, d)
+}
+
+func deviceFromContext(ctx context.Context) *Device {
+	d, _ := ctx.Value(deviceCtxKey{}).(*Device)
+	return d
+}
+
+func initDevicesTable() error {
+	query := `
+	CREATE TABLE IF NOT EXISTS devices (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	`
+	_, err := db.Exec(query)
+	return err
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func generateToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// createDevice registers a new device and returns it with its one-time
+// plaintext token populated.
+func createDevice(name string) (Device, error) {
+	token, err := generateToken()
+	if err != nil {
+		return Device{}, err
+	}
+
+	res, err := db.Exec("INSERT INTO devices (name, token_hash) VALUES (?, ?)", name, hashToken(token))
+	if err != nil {
+		return Device{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return Device{}, err
+	}
+
+	return Device{ID: id, Name: name, Token: token}, nil
+}
+
+func listDevices() ([]Device, error) {
+	rows, err := db.Query("SELECT id, name, created_at FROM devices ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var devices []Device
+	for rows.Next() {
+		var d Device
+		if err := rows.Scan(&d.ID, &d.Name, &d.CreatedAt); err != nil {
+			return nil, err
+		}
+		devices = append(devices, d)
+	}
+	return devices, nil
+}
+
+func deleteDevice(id int64) error {
+	_, err := db.Exec("DELETE FROM devices WHERE id = ?", id)
+	return err
+}
+
+func deviceByToken(token string) (*Device, error) {
+	var d Device
+	err := db.QueryRow("SELECT id, name, created_at FROM devices WHERE token_hash = ?", hashToken(token)).
+		Scan(&d.ID, &d.Name, &d.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errUnauthorized
+		}
+		return nil, err
+	}
+	return &d, nil
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer <token>"
+// header, or "" if the header is absent or malformed.
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if !strings.HasPrefix(header, prefix) {
+		return ""
+	}
+	return strings.TrimPrefix(header, prefix)
+}
+
+// authenticateDevice validates the request's bearer token against the
+// devices table.
+func authenticateDevice(r *http.Request) (*Device, error) {
+	token := bearerToken(r)
+	if token == "" {
+		return nil, errUnauthorized
+	}
+	return deviceByToken(token)
+}
+
+// requireAdmin reports whether the request carries the admin bearer
+// token configured via --admin-token.
+func requireAdmin(r *http.Request) bool {
+	return adminTokenValid(bearerToken(r))
+}
+
+// adminTokenValid compares token against the configured admin token in
+// constant time, to avoid leaking it through response timing.
+func adminTokenValid(token string) bool {
+	if cli.AdminToken == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(cli.AdminToken)) == 1
+}
+
+// handleDevices serves the device collection: creating a device (POST)
+// or listing existing ones (GET). Auth is enforced by the route table.
+func handleDevices(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		var body struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Name == "" {
+			http.Error(w, "Invalid JSON, name is required", http.StatusBadRequest)
+			return
+		}
+
+		device, err := createDevice(body.Name)
+		if err != nil {
+			log.Printf("Failed to create device: %v", err)
+			http.Error(w, "Failed to create device", http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, device)
+
+	case http.MethodGet:
+		devices, err := listDevices()
+		if err != nil {
+			log.Printf("Failed to list devices: %v", err)
+			http.Error(w, "Failed to list devices", http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, devices)
+	}
+}
+
+// handleDeviceByID serves /api/devices/{id}; currently only deletion.
+// Auth and method are enforced by the route table.
+func handleDeviceByID(w http.ResponseWriter, r *http.Request) {
+	idStr := strings.TrimPrefix(r.URL.Path, "/api/devices/")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid device id", http.StatusBadRequest)
+		return
+	}
+
+	if err := deleteDevice(id); err != nil {
+		log.Printf("Failed to delete device: %v", err)
+		http.Error(w, "Failed to delete device", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, map[string]string{"status": "ok"})
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"time"
+
+	"github.com/alecthomas/kong"
+)
+
+// CLI collects every runtime knob the server understands. Each field can
+// be set via flag or the matching environment variable, so deployments
+// that prefer env vars (systemd units, containers) keep working without
+// touching process env directly in the code.
+type CLI struct {
+	Addr     string `help:"Address to listen on." env:"BIKE_ADDR" default:"localhost"`
+	Port     string `help:"Port to listen on." env:"BIKE_PORT" default:"8080"`
+	MapStyle string `help:"Tile style JSON URL served to clients via /api/config." env:"BIKE_MAP_STYLE" default:"https://vector.openstreetmap.org/shortbread_v1/tilejson.json"`
+	DBPath   string `help:"Path to the SQLite database file." env:"BIKE_DB_PATH" default:"bike_tracker.db"`
+
+	TLSCert string `help:"Path to a TLS certificate; serves HTTPS when set together with --tls-key." env:"BIKE_TLS_CERT"`
+	TLSKey  string `help:"Path to the TLS private key." env:"BIKE_TLS_KEY"`
+
+	AdminToken string `help:"Bearer token required to manage devices via the admin API." env:"BIKE_ADMIN_TOKEN"`
+
+	LogLevel  string        `help:"Log verbosity: debug, info, warn or error." env:"BIKE_LOG_LEVEL" default:"info" enum:"debug,info,warn,error"`
+	Retention time.Duration `help:"How long to keep recorded positions before they are pruned; 0 disables pruning." env:"BIKE_RETENTION" default:"0"`
+
+	TripGap       time.Duration `help:"Time gap after which a device's next position starts a new trip." env:"BIKE_TRIP_GAP" default:"15m"`
+	TripGapMeters float64       `help:"Distance gap (meters) after which a device's next position starts a new trip." env:"BIKE_TRIP_GAP_METERS" default:"2000"`
+
+	WSQueueSize int `help:"Outbound message queue size per WebSocket connection before a slow client is dropped." env:"BIKE_WS_QUEUE_SIZE" default:"64"`
+}
+
+// parseCLI parses os.Args into a CLI, exiting the process with usage
+// output on error (kong's default behaviour).
+func parseCLI() CLI {
+	var cli CLI
+	kong.Parse(&cli,
+		kong.Name("bike-tracker"),
+		kong.Description("Self-hosted GPS tracker for bikes."),
+		kong.UsageOnError(),
+	)
+	return cli
+}
+
+// tlsEnabled reports whether both halves of a TLS key pair were
+// configured.
+func (c CLI) tlsEnabled() bool {
+	return c.TLSCert != "" && c.TLSKey != ""
+}
+
+// wsQueueSize returns the configured WebSocket send-queue size, falling
+// back to the default for a non-positive value so a bad flag or env var
+// can't make make(chan) panic.
+func (c CLI) wsQueueSize() int {
+	if c.WSQueueSize <= 0 {
+		return 64
+	}
+	return c.WSQueueSize
+}
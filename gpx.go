@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// exportFormat selects the interchange format produced by
+// handleHistoryExport.
+type exportFormat int
+
+const (
+	exportFormatGPX exportFormat = iota
+	exportFormatKML
+)
+
+// gpxDoc is a minimal GPX 1.1 document containing a single track made up
+// of the positions matched by the request.
+type gpxDoc struct {
+	XMLName xml.Name `xml:"gpx"`
+	Version string   `xml:"version,attr"`
+	Creator string   `xml:"creator,attr"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Track   gpxTrack `xml:"trk"`
+}
+
+type gpxTrack struct {
+	Name    string     `xml:"name"`
+	Segment gpxSegment `xml:"trkseg"`
+}
+
+type gpxSegment struct {
+	Points []gpxPoint `xml:"trkpt"`
+}
+
+type gpxPoint struct {
+	Lat  float64 `xml:"lat,attr"`
+	Lon  float64 `xml:"lon,attr"`
+	Time string  `xml:"time"`
+}
+
+// kmlDoc is a minimal KML 2.2 document with one Placemark per recorded
+// position, timestamped so the track can be replayed by viewers that
+// support gx:Track-style playback.
+type kmlDoc struct {
+	XMLName xml.Name   `xml:"kml"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Doc     kmlDocBody `xml:"Document"`
+}
+
+type kmlDocBody struct {
+	Name       string         `xml:"name"`
+	Placemarks []kmlPlacemark `xml:"Placemark"`
+}
+
+type kmlPlacemark struct {
+	TimeStamp kmlTimeStamp `xml:"TimeStamp"`
+	Point     kmlPoint     `xml:"Point"`
+}
+
+type kmlTimeStamp struct {
+	When string `xml:"when"`
+}
+
+type kmlPoint struct {
+	Coordinates string `xml:"coordinates"`
+}
+
+// handleHistoryExport returns a handler that renders the positions
+// matched by the from/to/track query parameters as the given format.
+func handleHistoryExport(format exportFormat) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		positions, err := queryHistory(r.URL.Query())
+		if err != nil {
+			log.Printf("Failed to query history for export: %v", err)
+			http.Error(w, "Failed to fetch history", http.StatusInternalServerError)
+			return
+		}
+
+		switch format {
+		case exportFormatGPX:
+			writeGPX(w, positions)
+		case exportFormatKML:
+			writeKML(w, positions)
+		}
+	}
+}
+
+// queryHistory fetches positions honouring the optional "from", "to" (unix
+// timestamps) and "track" (track id) query parameters.
+func queryHistory(params map[string][]string) ([]GPSPosition, error) {
+	query := "SELECT latitude, longitude, timestamp, track_id, device_id, trip_id, distance_m, speed_mps FROM positions WHERE 1=1"
+	var args []interface{}
+
+	if v := firstParam(params, "device"); v != "" {
+		deviceID, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid device: %w", err)
+		}
+		query += " AND device_id = ?"
+		args = append(args, deviceID)
+	}
+	if v := firstParam(params, "from"); v != "" {
+		from, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid from: %w", err)
+		}
+		query += " AND timestamp >= ?"
+		args = append(args, from)
+	}
+	if v := firstParam(params, "to"); v != "" {
+		to, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid to: %w", err)
+		}
+		query += " AND timestamp <= ?"
+		args = append(args, to)
+	}
+	if v := firstParam(params, "track"); v != "" {
+		track, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid track: %w", err)
+		}
+		query += " AND track_id = ?"
+		args = append(args, track)
+	}
+	if v := firstParam(params, "trip"); v != "" {
+		trip, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trip: %w", err)
+		}
+		query += " AND trip_id = ?"
+		args = append(args, trip)
+	}
+	query += " ORDER BY created_at"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var positions []GPSPosition
+	for rows.Next() {
+		var pos GPSPosition
+		if err := rows.Scan(
+			&pos.Latitude, &pos.Longitude, &pos.Timestamp,
+			&pos.TrackID, &pos.DeviceID, &pos.TripID, &pos.DistanceM, &pos.SpeedMps,
+		); err != nil {
+			return nil, err
+		}
+		positions = append(positions, pos)
+	}
+	return positions, nil
+}
+
+func firstParam(params map[string][]string, name string) string {
+	if values, ok := params[name]; ok && len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func writeGPX(w http.ResponseWriter, positions []GPSPosition) {
+	doc := gpxDoc{
+		Version: "1.1",
+		Creator: "bike-tracker",
+		Xmlns:   "http://www.topografix.com/GPX/1/1",
+		Track: gpxTrack{
+			Name: "Bike Tracker Export",
+		},
+	}
+	for _, pos := range positions {
+		doc.Track.Segment.Points = append(doc.Track.Segment.Points, gpxPoint{
+			Lat:  pos.Latitude,
+			Lon:  pos.Longitude,
+			Time: time.Unix(pos.Timestamp, 0).UTC().Format(time.RFC3339),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/gpx+xml")
+	w.Header().Set("Content-Disposition", `attachment; filename="history.gpx"`)
+	fmt.Fprint(w, xml.Header)
+	if err := xml.NewEncoder(w).Encode(doc); err != nil {
+		log.Printf("Failed to encode GPX: %v", err)
+	}
+}
+
+func writeKML(w http.ResponseWriter, positions []GPSPosition) {
+	doc := kmlDoc{
+		Xmlns: "http://www.opengis.net/kml/2.2",
+		Doc: kmlDocBody{
+			Name: "Bike Tracker Export",
+		},
+	}
+	for _, pos := range positions {
+		doc.Doc.Placemarks = append(doc.Doc.Placemarks, kmlPlacemark{
+			TimeStamp: kmlTimeStamp{When: time.Unix(pos.Timestamp, 0).UTC().Format(time.RFC3339)},
+			Point:     kmlPoint{Coordinates: fmt.Sprintf("%f,%f,0", pos.Longitude, pos.Latitude)},
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.google-earth.kml+xml")
+	w.Header().Set("Content-Disposition", `attachment; filename="history.kml"`)
+	fmt.Fprint(w, xml.Header)
+	if err := xml.NewEncoder(w).Encode(doc); err != nil {
+		log.Printf("Failed to encode KML: %v", err)
+	}
+}
+
+// handleImport accepts a multipart-uploaded GPX or KML file and replays
+// its points through the normal save path, preserving their original
+// timestamps and grouping them under a new track id.
+func handleImport(w http.ResponseWriter, r *http.Request) {
+	device := deviceFromContext(r.Context())
+
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		http.Error(w, "Invalid multipart upload", http.StatusBadRequest)
+		return
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "Missing file field", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	var points []GPSPosition
+	if isKMLFile(header.Filename) {
+		points, err = parseKML(file)
+	} else {
+		points, err = parseGPX(file)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to parse %s: %v", header.Filename, err), http.StatusBadRequest)
+		return
+	}
+
+	// Hold writeMu across both the track id reservation and every
+	// point's insert, so a concurrent import or live position can't
+	// read the same MAX(track_id)/MAX(trip_id) before this import has
+	// written anything.
+	writeMu.Lock()
+	defer writeMu.Unlock()
+
+	trackID, err := nextTrackID()
+	if err != nil {
+		log.Printf("Failed to allocate track id: %v", err)
+		http.Error(w, "Failed to import", http.StatusInternalServerError)
+		return
+	}
+
+	imported := 0
+	for _, point := range points {
+		point.TrackID = trackID
+		point.DeviceID = device.ID
+
+		exists, err := positionExists(point)
+		if err != nil {
+			log.Printf("Failed to check for duplicate position: %v", err)
+			continue
+		}
+		if exists {
+			continue
+		}
+
+		if _, err := savePositionLocked(point); err != nil {
+			log.Printf("Failed to save imported position: %v", err)
+			continue
+		}
+		imported++
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"status":   "ok",
+		"trackId":  trackID,
+		"imported": imported,
+		"total":    len(points),
+	})
+}
+
+func isKMLFile(filename string) bool {
+	return len(filename) >= 4 && filename[len(filename)-4:] == ".kml"
+}
+
+func parseGPX(r interface {
+	Read(p []byte) (int, error)
+}) ([]GPSPosition, error) {
+	var doc gpxDoc
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	var points []GPSPosition
+	for _, pt := range doc.Track.Segment.Points {
+		ts, err := time.Parse(time.RFC3339, pt.Time)
+		if err != nil {
+			continue
+		}
+		points = append(points, GPSPosition{
+			Latitude:  pt.Lat,
+			Longitude: pt.Lon,
+			Timestamp: ts.Unix(),
+		})
+	}
+	return points, nil
+}
+
+func parseKML(r interface {
+	Read(p []byte) (int, error)
+}) ([]GPSPosition, error) {
+	var doc kmlDoc
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	var points []GPSPosition
+	for _, pm := range doc.Doc.Placemarks {
+		ts, err := time.Parse(time.RFC3339, pm.TimeStamp.When)
+		if err != nil {
+			continue
+		}
+		var lon, lat, alt float64
+		if _, err := fmt.Sscanf(pm.Point.Coordinates, "%f,%f,%f", &lon, &lat, &alt); err != nil {
+			if _, err := fmt.Sscanf(pm.Point.Coordinates, "%f,%f", &lon, &lat); err != nil {
+				continue
+			}
+		}
+		points = append(points, GPSPosition{
+			Latitude:  lat,
+			Longitude: lon,
+			Timestamp: ts.Unix(),
+		})
+	}
+	return points, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGPXRoundTrip(t *testing.T) {
+	positions := []GPSPosition{
+		{Latitude: 52.520008, Longitude: 13.404954, Timestamp: 1700000000},
+		{Latitude: 52.521000, Longitude: 13.406000, Timestamp: 1700000060},
+	}
+
+	rec := httptest.NewRecorder()
+	writeGPX(rec, positions)
+
+	parsed, err := parseGPX(bytes.NewReader(rec.Body.Bytes()))
+	if err != nil {
+		t.Fatalf("parseGPX() error: %v", err)
+	}
+	if len(parsed) != len(positions) {
+		t.Fatalf("parseGPX() returned %d points, want %d", len(parsed), len(positions))
+	}
+	for i, want := range positions {
+		got := parsed[i]
+		if got.Latitude != want.Latitude || got.Longitude != want.Longitude || got.Timestamp != want.Timestamp {
+			t.Errorf("point %d = %+v, want lat=%v lon=%v ts=%v", i, got, want.Latitude, want.Longitude, want.Timestamp)
+		}
+	}
+}
+
+func TestKMLRoundTrip(t *testing.T) {
+	positions := []GPSPosition{
+		{Latitude: 52.520008, Longitude: 13.404954, Timestamp: 1700000000},
+		{Latitude: 52.521000, Longitude: 13.406000, Timestamp: 1700000060},
+	}
+
+	rec := httptest.NewRecorder()
+	writeKML(rec, positions)
+
+	parsed, err := parseKML(bytes.NewReader(rec.Body.Bytes()))
+	if err != nil {
+		t.Fatalf("parseKML() error: %v", err)
+	}
+	if len(parsed) != len(positions) {
+		t.Fatalf("parseKML() returned %d points, want %d", len(parsed), len(positions))
+	}
+	for i, want := range positions {
+		got := parsed[i]
+		if got.Latitude != want.Latitude || got.Longitude != want.Longitude || got.Timestamp != want.Timestamp {
+			t.Errorf("point %d = %+v, want lat=%v lon=%v ts=%v", i, got, want.Latitude, want.Longitude, want.Timestamp)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// authLevel is the access check a route requires before its handler
+// runs, mirroring the auth levels tailscale's ipn/localapi dispatches
+// on.
+type authLevel int
+
+const (
+	authNone authLevel = iota
+	authDevice
+	authAdmin
+)
+
+// apiRoute is one entry in the handler table: the methods it accepts,
+// the auth level required, and the handler itself. Method checking,
+// auth, logging, recovery, gzip and CORS are all handled once by
+// wrapRoute instead of being repeated in every handler.
+type apiRoute struct {
+	methods []string
+	auth    authLevel
+	handler http.HandlerFunc
+}
+
+// apiRoutes is the full handler table. Paths ending in "/" are subtree
+// matches, same as net/http.ServeMux.
+var apiRoutes = map[string]apiRoute{
+	"/api/config":        {methods: []string{http.MethodGet}, handler: handleConfig},
+	"/api/history":       {methods: []string{http.MethodGet}, auth: authAdmin, handler: handleHistory},
+	"/api/history.gpx":   {methods: []string{http.MethodGet}, auth: authAdmin, handler: handleHistoryExport(exportFormatGPX)},
+	"/api/history.kml":   {methods: []string{http.MethodGet}, auth: authAdmin, handler: handleHistoryExport(exportFormatKML)},
+	"/api/import":        {methods: []string{http.MethodPost}, auth: authDevice, handler: handleImport},
+	"/api/last-position": {methods: []string{http.MethodGet}, auth: authAdmin, handler: handleLastPosition},
+	"/api/devices":       {methods: []string{http.MethodGet, http.MethodPost}, auth: authAdmin, handler: handleDevices},
+	"/api/devices/":      {methods: []string{http.MethodDelete}, auth: authAdmin, handler: handleDeviceByID},
+	"/api/trips":         {methods: []string{http.MethodGet}, auth: authAdmin, handler: handleTrips},
+	"/api/trips/":        {methods: []string{http.MethodGet}, auth: authAdmin, handler: handleTripByID},
+	"/position":          {methods: []string{http.MethodPost}, auth: authDevice, handler: handlePosition},
+}
+
+// registerRoutes wires every entry of apiRoutes into mux, each wrapped
+// in the standard middleware chain.
+func registerRoutes(mux *http.ServeMux) {
+	for path, route := range apiRoutes {
+		mux.Handle(path, wrapRoute(route))
+	}
+}
+
+// wrapRoute applies the common middleware chain (logging, panic
+// recovery, gzip) around a route's method/auth checks and handler.
+func wrapRoute(route apiRoute) http.Handler {
+	var h http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dispatchRoute(w, r, route)
+	})
+	h = corsMiddleware(route.methods, h)
+	h = gzipMiddleware(h)
+	h = recoverMiddleware(h)
+	h = loggingMiddleware(h)
+	return h
+}
+
+func dispatchRoute(w http.ResponseWriter, r *http.Request, route apiRoute) {
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if !methodAllowed(route.methods, r.Method) {
+		methodNotAllowed(w, route.methods)
+		return
+	}
+
+	switch route.auth {
+	case authAdmin:
+		if !requireAdmin(r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	case authDevice:
+		device, err := authenticateDevice(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		r = r.WithContext(withDevice(r.Context(), device))
+	}
+
+	route.handler(w, r)
+}
+
+func methodAllowed(methods []string, method string) bool {
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// writeJSON encodes v as the response body with the JSON content type
+// set, logging (but not failing the request further) if encoding fails.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to encode JSON response: %v", err)
+	}
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed []string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+}
+
+// loggingMiddleware logs the method, path and duration of every request.
+func loggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		next.ServeHTTP(w, r)
+		debugf("%s %s (%s)", r.Method, r.URL.Path, time.Since(start))
+	})
+}
+
+// recoverMiddleware turns a panicking handler into a 500 instead of
+// taking down the server.
+func recoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				log.Printf("Panic handling %s %s: %v", r.Method, r.URL.Path, err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// corsMiddleware allows the API to be called from browser clients hosted
+// elsewhere than the tracker itself (e.g. a separate dashboard origin).
+func corsMiddleware(methods []string, next http.Handler) http.Handler {
+	allowMethods := strings.Join(append([]string{http.MethodOptions}, methods...), ", ")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", allowMethods)
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// gzipMiddleware compresses the response when the client advertises
+// support for it.
+func gzipMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Add("Vary", "Accept-Encoding")
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		next.ServeHTTP(gzipResponseWriter{ResponseWriter: w, writer: gz}, r)
+	})
+}
+
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	writer *gzip.Writer
+}
+
+func (w gzipResponseWriter) Write(b []byte) (int, error) {
+	return w.writer.Write(b)
+}
@@ -0,0 +1,14 @@
+package main
+
+import "log"
+
+// logLevel is the minimum severity that debugf will emit, set once from
+// CLI.LogLevel at startup.
+var logLevel = "info"
+
+// debugf logs at debug severity; a no-op unless --log-level=debug.
+func debugf(format string, args ...interface{}) {
+	if logLevel == "debug" {
+		log.Printf("[debug] "+format, args...)
+	}
+}
@@ -8,11 +8,10 @@ import (
 	"io/fs"
 	"log"
 	"net/http"
-	"os"
+	"strconv"
 	"sync"
 	"time"
 
-	"github.com/gorilla/websocket"
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -23,27 +22,36 @@ type GPSPosition struct {
 	Latitude  float64 `json:"latitude"`
 	Longitude float64 `json:"longitude"`
 	Timestamp int64   `json:"timestamp"`
+	TrackID   int64   `json:"trackId,omitempty"`
+	DeviceID  int64   `json:"deviceId,omitempty"`
+
+	TripID    int64   `json:"tripId,omitempty"`
+	DistanceM float64 `json:"distanceM,omitempty"`
+	SpeedMps  float64 `json:"speedMps,omitempty"`
 }
 
 type Config struct {
 	MapStyle string `json:"mapStyle"`
 }
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
-}
-
 var (
-	connections = make(map[*websocket.Conn]bool)
-	connMutex   sync.RWMutex
-	db          *sql.DB
+	db  *sql.DB
+	cli CLI
+
+	// writeMu serializes the read-max-then-insert sequences that
+	// allocate track/trip ids, since SQLite won't do it for us across
+	// two separate statements: without it, concurrent savePosition (or
+	// import) calls can read the same MAX(...) before either has
+	// inserted, handing out duplicate ids.
+	writeMu sync.Mutex
 )
 
 func main() {
+	cli = parseCLI()
+	logLevel = cli.LogLevel
+
 	var err error
-	db, err = sql.Open("sqlite3", "bike_tracker.db")
+	db, err = sql.Open("sqlite3", cli.DBPath)
 	if err != nil {
 		log.Fatal("Failed to open database:", err)
 	}
@@ -53,14 +61,8 @@ func main() {
 		log.Fatal("Failed to initialize database:", err)
 	}
 
-	addr := os.Getenv("ADDR")
-	if addr == "" {
-		addr = "localhost"
-	}
-
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	if cli.Retention > 0 {
+		go runRetention(cli.Retention)
 	}
 
 	staticFS, err := fs.Sub(staticFiles, "static")
@@ -68,51 +70,41 @@ func main() {
 		log.Fatal("Failed to create static filesystem:", err)
 	}
 
-	http.Handle("/", http.FileServer(http.FS(staticFS)))
-	http.HandleFunc("/ws", handleWebSocket)
-	http.HandleFunc("/api/config", handleConfig)
-	http.HandleFunc("/api/history", handleHistory)
-	http.HandleFunc("/api/last-position", handleLastPosition)
-	http.HandleFunc("/position", handlePosition)
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServer(http.FS(staticFS)))
+	mux.HandleFunc("/ws", handleWebSocket)
+	registerRoutes(mux)
 
-	serverAddr := fmt.Sprintf("%s:%s", addr, port)
-	log.Printf("Server starting on http://%s", serverAddr)
-	log.Fatal(http.ListenAndServe(serverAddr, nil))
-}
-
-func handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Printf("WebSocket upgrade failed: %v", err)
-		return
+	serverAddr := fmt.Sprintf("%s:%s", cli.Addr, cli.Port)
+	if cli.tlsEnabled() {
+		log.Printf("Server starting on https://%s", serverAddr)
+		log.Fatal(http.ListenAndServeTLS(serverAddr, cli.TLSCert, cli.TLSKey, mux))
 	}
-	defer func() {
-		conn.Close()
-		connMutex.Lock()
-		delete(connections, conn)
-		connMutex.Unlock()
-	}()
 
-	log.Printf("Client connected: %s", conn.RemoteAddr())
+	log.Printf("Server starting on http://%s", serverAddr)
+	log.Fatal(http.ListenAndServe(serverAddr, mux))
+}
 
-	connMutex.Lock()
-	connections[conn] = true
-	connMutex.Unlock()
+// runRetention periodically prunes positions older than maxAge.
+func runRetention(maxAge time.Duration) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
 
-	for {
-		_, _, err := conn.ReadMessage()
+	for range ticker.C {
+		cutoff := time.Now().Add(-maxAge).Unix()
+		res, err := db.Exec("DELETE FROM positions WHERE timestamp < ?", cutoff)
 		if err != nil {
-			log.Printf("WebSocket read failed: %v", err)
-			break
+			log.Printf("Failed to prune old positions: %v", err)
+			continue
+		}
+		if n, err := res.RowsAffected(); err == nil && n > 0 {
+			debugf("Pruned %d positions older than %s", n, maxAge)
 		}
 	}
 }
 
 func handlePosition(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
+	device := deviceFromContext(r.Context())
 
 	var position GPSPosition
 	if err := json.NewDecoder(r.Body).Decode(&position); err != nil {
@@ -121,46 +113,24 @@ func handlePosition(w http.ResponseWriter, r *http.Request) {
 	}
 
 	position.Timestamp = time.Now().Unix()
+	position.DeviceID = device.ID
 
-	if err := savePosition(position); err != nil {
+	saved, err := savePosition(position)
+	if err != nil {
 		log.Printf("Failed to save position: %v", err)
 		http.Error(w, "Failed to save position", http.StatusInternalServerError)
 		return
 	}
 
-	broadcastPosition(position)
+	broadcastPosition(saved)
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	writeJSON(w, map[string]string{"status": "ok"})
 
 	log.Printf("Received position: lat=%.6f, lng=%.6f", position.Latitude, position.Longitude)
 }
 
-func broadcastPosition(position GPSPosition) {
-	connMutex.RLock()
-	defer connMutex.RUnlock()
-
-	for conn := range connections {
-		if err := conn.WriteJSON(position); err != nil {
-			log.Printf("WebSocket write failed: %v", err)
-			conn.Close()
-			delete(connections, conn)
-		}
-	}
-}
-
 func handleConfig(w http.ResponseWriter, r *http.Request) {
-	mapStyle := os.Getenv("MAP_STYLE")
-	if mapStyle == "" {
-		mapStyle = "https://vector.openstreetmap.org/shortbread_v1/tilejson.json"
-	}
-
-	config := Config{
-		MapStyle: mapStyle,
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(config)
+	writeJSON(w, Config{MapStyle: cli.MapStyle})
 }
 
 func initDB() error {
@@ -170,62 +140,216 @@ func initDB() error {
 		latitude REAL NOT NULL,
 		longitude REAL NOT NULL,
 		timestamp INTEGER NOT NULL,
+		track_id INTEGER NOT NULL DEFAULT 0,
+		device_id INTEGER NOT NULL DEFAULT 0,
+		trip_id INTEGER NOT NULL DEFAULT 0,
+		distance_m REAL NOT NULL DEFAULT 0,
+		speed_mps REAL NOT NULL DEFAULT 0,
 		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
 	);
 	`
-	_, err := db.Exec(query)
-	return err
+	if _, err := db.Exec(query); err != nil {
+		return err
+	}
+	columns := map[string]string{
+		"track_id":   "INTEGER NOT NULL DEFAULT 0",
+		"device_id":  "INTEGER NOT NULL DEFAULT 0",
+		"trip_id":    "INTEGER NOT NULL DEFAULT 0",
+		"distance_m": "REAL NOT NULL DEFAULT 0",
+		"speed_mps":  "REAL NOT NULL DEFAULT 0",
+	}
+	for column, definition := range columns {
+		if err := addColumnIfMissing("positions", column, definition); err != nil {
+			return err
+		}
+	}
+	return initDevicesTable()
 }
 
-func savePosition(position GPSPosition) error {
-	query := "INSERT INTO positions (latitude, longitude, timestamp) VALUES (?, ?, ?)"
-	_, err := db.Exec(query, position.Latitude, position.Longitude, position.Timestamp)
+// addColumnIfMissing runs an ALTER TABLE ADD COLUMN for databases created
+// before the column existed; SQLite has no "ADD COLUMN IF NOT EXISTS".
+func addColumnIfMissing(table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			ctype      string
+			notNull    int
+			dfltValue  sql.NullString
+			primaryKey int
+		)
+		if err := rows.Scan(&cid, &name, &ctype, &notNull, &dfltValue, &primaryKey); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
 	return err
 }
 
-func handleHistory(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// savePosition inserts position after computing its trip segmentation,
+// distance and speed relative to the same device's previous point, and
+// returns the enriched row actually stored.
+func savePosition(position GPSPosition) (GPSPosition, error) {
+	writeMu.Lock()
+	defer writeMu.Unlock()
+	return savePositionLocked(position)
+}
+
+// savePositionLocked does the work of savePosition, assuming the caller
+// already holds writeMu. It exists so callers that also need to hold
+// writeMu across their own id allocation (e.g. handleImport reserving a
+// track id) can save multiple positions without releasing the lock
+// in between.
+func savePositionLocked(position GPSPosition) (GPSPosition, error) {
+	position, err := assignTrip(position)
+	if err != nil {
+		return position, err
+	}
+
+	query := `
+	INSERT INTO positions (latitude, longitude, timestamp, track_id, device_id, trip_id, distance_m, speed_mps)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	_, err = db.Exec(query,
+		position.Latitude, position.Longitude, position.Timestamp,
+		position.TrackID, position.DeviceID,
+		position.TripID, position.DistanceM, position.SpeedMps,
+	)
+	return position, err
+}
+
+// assignTrip fills in TripID, DistanceM and SpeedMps for position based
+// on the same device's previous point, starting a new trip when the
+// time or distance gap exceeds the configured thresholds.
+func assignTrip(position GPSPosition) (GPSPosition, error) {
+	prev, err := lastPositionForDevice(position.DeviceID)
+	if err != nil && err != sql.ErrNoRows {
+		return position, err
+	}
+	if err == sql.ErrNoRows {
+		tripID, err := nextTripID()
+		if err != nil {
+			return position, err
+		}
+		position.TripID = tripID
+		return position, nil
 	}
 
-	query := "SELECT latitude, longitude, timestamp FROM positions ORDER BY created_at"
-	rows, err := db.Query(query)
+	distance := haversineMeters(prev.Latitude, prev.Longitude, position.Latitude, position.Longitude)
+	elapsed := position.Timestamp - prev.Timestamp
+
+	if elapsed > int64(cli.TripGap.Seconds()) || distance > cli.TripGapMeters {
+		// A new trip starts here, so distance/speed relative to the
+		// previous (unrelated) trip's last point would corrupt this
+		// trip's own SUM(distance_m)/MAX(speed_mps); leave them zero.
+		tripID, err := nextTripID()
+		if err != nil {
+			return position, err
+		}
+		position.TripID = tripID
+		return position, nil
+	}
+
+	position.DistanceM = distance
+	if elapsed > 0 {
+		position.SpeedMps = distance / float64(elapsed)
+	}
+	position.TripID = prev.TripID
+
+	return position, nil
+}
+
+// lastPositionForDevice returns the most recently recorded position for
+// a device, or sql.ErrNoRows if it has none yet.
+func lastPositionForDevice(deviceID int64) (GPSPosition, error) {
+	var pos GPSPosition
+	err := db.QueryRow(
+		"SELECT latitude, longitude, timestamp, track_id, device_id, trip_id FROM positions WHERE device_id = ? ORDER BY created_at DESC, id DESC LIMIT 1",
+		deviceID,
+	).Scan(&pos.Latitude, &pos.Longitude, &pos.Timestamp, &pos.TrackID, &pos.DeviceID, &pos.TripID)
+	return pos, err
+}
+
+// nextTripID returns a fresh, globally unique trip id so /api/trips/{id}
+// can address a trip without also needing its device id.
+func nextTripID() (int64, error) {
+	var maxID int64
+	if err := db.QueryRow("SELECT COALESCE(MAX(trip_id), 0) FROM positions").Scan(&maxID); err != nil {
+		return 0, err
+	}
+	return maxID + 1, nil
+}
+
+// positionExists reports whether the same device already has a position
+// with the same timestamp and coordinates recorded, so imports can be
+// replayed without creating duplicate rows. Scoped to device_id so two
+// devices that happen to share a timestamp+coordinate (re-imports,
+// shared fixture files) don't shadow each other.
+func positionExists(position GPSPosition) (bool, error) {
+	var count int
+	err := db.QueryRow(
+		"SELECT COUNT(1) FROM positions WHERE timestamp = ? AND latitude = ? AND longitude = ? AND device_id = ?",
+		position.Timestamp, position.Latitude, position.Longitude, position.DeviceID,
+	).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// nextTrackID returns a fresh track id for a newly imported file, one
+// greater than the highest track id currently stored.
+func nextTrackID() (int64, error) {
+	var maxID int64
+	if err := db.QueryRow("SELECT COALESCE(MAX(track_id), 0) FROM positions").Scan(&maxID); err != nil {
+		return 0, err
+	}
+	return maxID + 1, nil
+}
+
+func handleHistory(w http.ResponseWriter, r *http.Request) {
+	positions, err := queryHistory(r.URL.Query())
 	if err != nil {
 		log.Printf("Failed to query history: %v", err)
 		http.Error(w, "Failed to fetch history", http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
-
-	var positions []GPSPosition
-	for rows.Next() {
-		var pos GPSPosition
-		if err := rows.Scan(&pos.Latitude, &pos.Longitude, &pos.Timestamp); err != nil {
-			log.Printf("Failed to scan row: %v", err)
-			continue
-		}
-		positions = append(positions, pos)
-	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(positions)
+	writeJSON(w, positions)
 }
 
 func handleLastPosition(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+	query := "SELECT latitude, longitude, timestamp, track_id, device_id, trip_id, distance_m, speed_mps FROM positions WHERE 1=1"
+	var args []interface{}
+	if v := r.URL.Query().Get("device"); v != "" {
+		deviceID, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid device", http.StatusBadRequest)
+			return
+		}
+		query += " AND device_id = ?"
+		args = append(args, deviceID)
 	}
+	query += " ORDER BY created_at DESC LIMIT 1"
 
-	query := "SELECT latitude, longitude, timestamp FROM positions ORDER BY created_at DESC LIMIT 1"
 	var position GPSPosition
-	
-	err := db.QueryRow(query).Scan(&position.Latitude, &position.Longitude, &position.Timestamp)
+	err := db.QueryRow(query, args...).Scan(
+		&position.Latitude, &position.Longitude, &position.Timestamp,
+		&position.TrackID, &position.DeviceID, &position.TripID, &position.DistanceM, &position.SpeedMps,
+	)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(nil)
+			writeJSON(w, nil)
 			return
 		}
 		log.Printf("Failed to query last position: %v", err)
@@ -233,6 +357,5 @@ func handleLastPosition(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(position)
+	writeJSON(w, position)
 }
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"database/sql"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const earthRadiusMeters = 6371000.0
+
+// haversineMeters returns the great-circle distance between two
+// lat/lng points in meters.
+func haversineMeters(lat1, lon1, lat2, lon2 float64) float64 {
+	lat1Rad := lat1 * math.Pi / 180
+	lat2Rad := lat2 * math.Pi / 180
+	dLat := (lat2 - lat1) * math.Pi / 180
+	dLon := (lon2 - lon1) * math.Pi / 180
+
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1Rad)*math.Cos(lat2Rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	c := 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+
+	return earthRadiusMeters * c
+}
+
+// TripSummary describes one trip: a run of positions from a single
+// device without a gap large enough to start a new trip.
+type TripSummary struct {
+	ID          int64   `json:"id"`
+	DeviceID    int64   `json:"deviceId"`
+	Start       int64   `json:"start"`
+	End         int64   `json:"end"`
+	DurationS   int64   `json:"durationSeconds"`
+	DistanceM   float64 `json:"distanceM"`
+	AvgSpeedMps float64 `json:"avgSpeedMps"`
+	MaxSpeedMps float64 `json:"maxSpeedMps"`
+	MinLat      float64 `json:"minLat"`
+	MaxLat      float64 `json:"maxLat"`
+	MinLon      float64 `json:"minLon"`
+	MaxLon      float64 `json:"maxLon"`
+}
+
+const tripSummaryQuery = `
+SELECT
+	trip_id,
+	MIN(device_id),
+	MIN(timestamp),
+	MAX(timestamp),
+	SUM(distance_m),
+	MAX(speed_mps),
+	MIN(latitude),
+	MAX(latitude),
+	MIN(longitude),
+	MAX(longitude)
+FROM positions
+WHERE trip_id = COALESCE(?, trip_id)
+GROUP BY trip_id
+ORDER BY MIN(timestamp)
+`
+
+func scanTripSummary(rows interface {
+	Scan(dest ...interface{}) error
+}) (TripSummary, error) {
+	var t TripSummary
+	err := rows.Scan(
+		&t.ID, &t.DeviceID, &t.Start, &t.End, &t.DistanceM, &t.MaxSpeedMps,
+		&t.MinLat, &t.MaxLat, &t.MinLon, &t.MaxLon,
+	)
+	if err != nil {
+		return t, err
+	}
+	t.DurationS = t.End - t.Start
+	if t.DurationS > 0 {
+		t.AvgSpeedMps = t.DistanceM / float64(t.DurationS)
+	}
+	return t, nil
+}
+
+// handleTrips lists a summary for every recorded trip.
+func handleTrips(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(tripSummaryQuery, nil)
+	if err != nil {
+		http.Error(w, "Failed to fetch trips", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var trips []TripSummary
+	for rows.Next() {
+		t, err := scanTripSummary(rows)
+		if err != nil {
+			http.Error(w, "Failed to fetch trips", http.StatusInternalServerError)
+			return
+		}
+		trips = append(trips, t)
+	}
+
+	writeJSON(w, trips)
+}
+
+// handleTripByID serves /api/trips/{id}: the trip's summary plus its
+// full recorded track.
+func handleTripByID(w http.ResponseWriter, r *http.Request) {
+	idStr := strings.TrimPrefix(r.URL.Path, "/api/trips/")
+	tripID, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid trip id", http.StatusBadRequest)
+		return
+	}
+
+	summary, err := scanTripSummary(db.QueryRow(tripSummaryQuery, tripID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Trip not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to fetch trip", http.StatusInternalServerError)
+		return
+	}
+
+	track, err := queryHistory(map[string][]string{"trip": {idStr}})
+	if err != nil {
+		http.Error(w, "Failed to fetch trip track", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"summary": summary,
+		"track":   track,
+	})
+}
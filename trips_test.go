@@ -0,0 +1,92 @@
+package main
+
+import (
+	"database/sql"
+	"math"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// setupTripTestDB points the package-level db at a fresh in-memory
+// database and configures cli with trip-gap thresholds tight enough to
+// exercise trip boundaries deterministically in a test.
+func setupTripTestDB(t *testing.T) {
+	t.Helper()
+
+	var err error
+	db, err = sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("failed to open test db: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if err := initDB(); err != nil {
+		t.Fatalf("failed to init test db: %v", err)
+	}
+
+	cli = CLI{
+		TripGap:       1 * time.Minute,
+		TripGapMeters: 50,
+	}
+}
+
+func TestHaversineMetersKnownDistance(t *testing.T) {
+	// Berlin to Paris is ~878km.
+	got := haversineMeters(52.520008, 13.404954, 48.864716, 2.349014)
+	want := 878000.0
+	if math.Abs(got-want) > 5000 {
+		t.Errorf("haversineMeters() = %.0fm, want ~%.0fm", got, want)
+	}
+
+	if got := haversineMeters(52.5, 13.4, 52.5, 13.4); got != 0 {
+		t.Errorf("haversineMeters() for identical points = %v, want 0", got)
+	}
+}
+
+// TestAssignTripNewTripBoundary covers the bug where the first point of
+// a new trip inherited distance/speed computed against the previous
+// trip's last point instead of starting at zero.
+func TestAssignTripNewTripBoundary(t *testing.T) {
+	setupTripTestDB(t)
+
+	first, err := savePosition(GPSPosition{
+		Latitude: 52.5, Longitude: 13.4, Timestamp: 1000, DeviceID: 1,
+	})
+	if err != nil {
+		t.Fatalf("savePosition(first) error: %v", err)
+	}
+	if first.DistanceM != 0 || first.SpeedMps != 0 {
+		t.Errorf("first position in a device's history: DistanceM=%v SpeedMps=%v, want 0, 0", first.DistanceM, first.SpeedMps)
+	}
+
+	// Small move, well within both thresholds: continues the same trip.
+	continued, err := savePosition(GPSPosition{
+		Latitude: 52.50005, Longitude: 13.40005, Timestamp: 1010, DeviceID: 1,
+	})
+	if err != nil {
+		t.Fatalf("savePosition(continued) error: %v", err)
+	}
+	if continued.TripID != first.TripID {
+		t.Errorf("continued.TripID = %d, want %d (same trip)", continued.TripID, first.TripID)
+	}
+	if continued.DistanceM <= 0 {
+		t.Errorf("continued.DistanceM = %v, want > 0", continued.DistanceM)
+	}
+
+	// Large time+distance gap: starts a new trip, so distance/speed must
+	// be zero rather than computed against the previous trip's last point.
+	next, err := savePosition(GPSPosition{
+		Latitude: 10.0, Longitude: 10.0, Timestamp: 100000, DeviceID: 1,
+	})
+	if err != nil {
+		t.Fatalf("savePosition(next) error: %v", err)
+	}
+	if next.TripID == continued.TripID {
+		t.Fatalf("next.TripID = %d, want a new trip id", next.TripID)
+	}
+	if next.DistanceM != 0 || next.SpeedMps != 0 {
+		t.Errorf("first position of a new trip: DistanceM=%v SpeedMps=%v, want 0, 0", next.DistanceM, next.SpeedMps)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsWriteTimeout   = 10 * time.Second
+	wsPongTimeout    = 60 * time.Second
+	wsPingInterval   = (wsPongTimeout * 9) / 10
+	historyChunkSize = 500
+)
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+// wsClient is one live WebSocket connection. Writes never happen
+// directly on conn from more than one goroutine: everything goes
+// through send, which writePump drains, so a stalled client can never
+// block the broadcaster that feeds every other connection.
+type wsClient struct {
+	conn *websocket.Conn
+	send chan interface{}
+
+	mu           sync.Mutex
+	live         bool
+	deviceFilter int64
+}
+
+// subscribeMessage is the only client-to-server message the protocol
+// defines: it requests replay of history since a point in time (and
+// optionally scoped to one device), followed by live updates.
+type subscribeMessage struct {
+	Op     string `json:"op"`
+	Since  int64  `json:"since"`
+	Device string `json:"device"`
+}
+
+// connections is the set of currently live WebSocket clients.
+var (
+	connections = make(map[*wsClient]bool)
+	connMutex   sync.RWMutex
+)
+
+func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	// Browser WebSocket clients can't set an Authorization header on the
+	// upgrade request, so the admin token travels as a query param here
+	// instead; the history this connection can replay and subscribe to
+	// is exactly what /api/history already requires it for.
+	if !adminTokenValid(r.URL.Query().Get("token")) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("WebSocket upgrade failed: %v", err)
+		return
+	}
+	log.Printf("Client connected: %s", conn.RemoteAddr())
+
+	client := &wsClient{
+		conn: conn,
+		send: make(chan interface{}, cli.wsQueueSize()),
+	}
+
+	connMutex.Lock()
+	connections[client] = true
+	connMutex.Unlock()
+
+	go client.writePump()
+	client.readPump()
+
+	// Close the conn (not client.send): a subscribe() goroutine spawned
+	// from readPump may still be replaying history and sending on
+	// client.send concurrently, and sending on a closed channel panics.
+	// Closing the conn instead makes writePump and any in-flight
+	// trySend calls fail or no-op safely; the channel is left for the
+	// garbage collector once both goroutines are done with it.
+	client.conn.Close()
+
+	connMutex.Lock()
+	delete(connections, client)
+	connMutex.Unlock()
+}
+
+// writePump is the only goroutine that ever calls conn.WriteMessage, so
+// concurrent sends (history replay, live broadcast, pings) can't race on
+// the underlying connection.
+func (c *wsClient) writePump() {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case msg, ok := <-c.send:
+			if !ok {
+				c.conn.Close()
+				return
+			}
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := c.conn.WriteJSON(msg); err != nil {
+				log.Printf("WebSocket write failed: %v", err)
+				c.conn.Close()
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				c.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+func (c *wsClient) readPump() {
+	c.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	c.conn.SetPongHandler(func(string) error {
+		c.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+		return nil
+	})
+
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			break
+		}
+
+		var msg subscribeMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			continue
+		}
+		if msg.Op == "subscribe" {
+			go c.subscribe(msg)
+		}
+	}
+}
+
+// subscribe replays history matching the request in chunks, emits a
+// {"type":"live"} marker, and only then starts forwarding live
+// broadcasts to this client.
+func (c *wsClient) subscribe(msg subscribeMessage) {
+	params := map[string][]string{}
+	if msg.Since > 0 {
+		params["from"] = []string{strconv.FormatInt(msg.Since, 10)}
+	}
+	var deviceFilter int64
+	if msg.Device != "" {
+		params["device"] = []string{msg.Device}
+		if id, err := strconv.ParseInt(msg.Device, 10, 64); err == nil {
+			deviceFilter = id
+		}
+	}
+
+	positions, err := queryHistory(params)
+	if err != nil {
+		log.Printf("Failed to replay history for subscriber: %v", err)
+		return
+	}
+
+	for start := 0; start < len(positions); start += historyChunkSize {
+		end := start + historyChunkSize
+		if end > len(positions) {
+			end = len(positions)
+		}
+		if !c.trySend(map[string]interface{}{
+			"type":      "history",
+			"positions": positions[start:end],
+		}) {
+			return
+		}
+	}
+
+	// Queue the marker while still holding mu, so broadcastPosition can't
+	// see live=true and enqueue a position ahead of it.
+	c.mu.Lock()
+	c.deviceFilter = deviceFilter
+	c.live = true
+	c.trySend(map[string]interface{}{"type": "live"})
+	c.mu.Unlock()
+}
+
+// trySend enqueues msg without blocking. If the client's queue is full
+// it is too slow to keep up, so it is dropped instead of stalling the
+// sender (the broadcaster, or this replay goroutine).
+func (c *wsClient) trySend(msg interface{}) bool {
+	select {
+	case c.send <- msg:
+		return true
+	default:
+		log.Printf("Dropping slow WebSocket client %s", c.conn.RemoteAddr())
+		c.conn.Close()
+		return false
+	}
+}
+
+// broadcastPosition forwards a newly saved position to every client
+// that has finished its history replay and whose device filter (if any)
+// matches.
+func broadcastPosition(position GPSPosition) {
+	connMutex.RLock()
+	defer connMutex.RUnlock()
+
+	for client := range connections {
+		client.mu.Lock()
+		live := client.live
+		filter := client.deviceFilter
+		client.mu.Unlock()
+
+		if !live {
+			continue
+		}
+		if filter != 0 && filter != position.DeviceID {
+			continue
+		}
+		client.trySend(position)
+	}
+}